@@ -0,0 +1,86 @@
+package ginprom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestContext(method, target, authHeader string) *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(method, target, nil)
+	if authHeader != "" {
+		c.Request.Header.Set("Authorization", authHeader)
+	}
+	return c
+}
+
+func TestAuthorizedOpenByDefault(t *testing.T) {
+	p := New(Registry(prometheus.NewRegistry()))
+
+	if !p.authorized(newTestContext(http.MethodGet, "/metrics", "")) {
+		t.Fatal("expected the route to be open when no Token, Tokens or Auth is configured")
+	}
+}
+
+func TestAuthorizedToken(t *testing.T) {
+	p := New(Registry(prometheus.NewRegistry()), Token("secret"))
+
+	if p.authorized(newTestContext(http.MethodGet, "/metrics", "")) {
+		t.Fatal("expected a missing Authorization header to be rejected")
+	}
+	if p.authorized(newTestContext(http.MethodGet, "/metrics", "Bearer wrong")) {
+		t.Fatal("expected a wrong token to be rejected")
+	}
+	if !p.authorized(newTestContext(http.MethodGet, "/metrics", "Bearer secret")) {
+		t.Fatal("expected the configured token to be accepted")
+	}
+}
+
+func TestAuthorizedDirectTokenAssignment(t *testing.T) {
+	// The pre-existing p.Token = "..." idiom must keep gating the endpoint,
+	// not just the Token() option.
+	p := New(Registry(prometheus.NewRegistry()))
+	p.Token = "secret"
+
+	if p.authorized(newTestContext(http.MethodGet, "/metrics", "")) {
+		t.Fatal("expected a missing Authorization header to be rejected")
+	}
+	if !p.authorized(newTestContext(http.MethodGet, "/metrics", "Bearer secret")) {
+		t.Fatal("expected the directly-assigned token to be accepted")
+	}
+}
+
+func TestAuthorizedTokensRotation(t *testing.T) {
+	p := New(Registry(prometheus.NewRegistry()), Tokens("old", "new"))
+
+	if !p.authorized(newTestContext(http.MethodGet, "/metrics", "Bearer old")) {
+		t.Fatal("expected the old token to still be accepted during rotation")
+	}
+	if !p.authorized(newTestContext(http.MethodGet, "/metrics", "Bearer new")) {
+		t.Fatal("expected the new token to be accepted during rotation")
+	}
+	if p.authorized(newTestContext(http.MethodGet, "/metrics", "Bearer stale")) {
+		t.Fatal("expected an unrelated token to be rejected")
+	}
+}
+
+func TestAuthorizedCustomAuthFunc(t *testing.T) {
+	p := New(Registry(prometheus.NewRegistry()), Auth(func(c *gin.Context) bool {
+		return c.Request.Header.Get("X-Internal") == "yes"
+	}), Token("ignored-when-auth-is-set"))
+
+	if p.authorized(newTestContext(http.MethodGet, "/metrics", "Bearer ignored-when-auth-is-set")) {
+		t.Fatal("expected Auth to take over from Token entirely")
+	}
+
+	c := newTestContext(http.MethodGet, "/metrics", "")
+	c.Request.Header.Set("X-Internal", "yes")
+	if !p.authorized(c) {
+		t.Fatal("expected Auth's own check to decide when configured")
+	}
+}
@@ -0,0 +1,116 @@
+package ginprom
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// responseDelegator wraps a gin.ResponseWriter to track status code and
+// bytes written independently of gin's own bookkeeping, which reports
+// Size() as -1 before the first write and can leave Status() pointing at
+// whatever was last set before a connection is hijacked (e.g. a websocket
+// upgrade). It embeds the wrapped writer so every other method, including
+// Flush and CloseNotify, is forwarded unchanged; Hijack is forwarded too,
+// but also records whether it succeeded.
+type responseDelegator struct {
+	gin.ResponseWriter
+
+	status   int
+	size     int
+	wroteHdr bool
+	hijacked bool
+}
+
+// newResponseDelegator wraps w to observe status, size and hijacking.
+func newResponseDelegator(w gin.ResponseWriter) *responseDelegator {
+	return &responseDelegator{ResponseWriter: w}
+}
+
+func (d *responseDelegator) WriteHeader(code int) {
+	if !d.wroteHdr {
+		d.status = code
+		d.wroteHdr = true
+	}
+	d.ResponseWriter.WriteHeader(code)
+}
+
+func (d *responseDelegator) Write(b []byte) (int, error) {
+	if !d.wroteHdr {
+		d.WriteHeader(http.StatusOK)
+	}
+	n, err := d.ResponseWriter.Write(b)
+	d.size += n
+	return n, err
+}
+
+func (d *responseDelegator) WriteString(s string) (int, error) {
+	if !d.wroteHdr {
+		d.WriteHeader(http.StatusOK)
+	}
+	n, err := d.ResponseWriter.WriteString(s)
+	d.size += n
+	return n, err
+}
+
+// Hijack forwards to the wrapped writer and, only once it actually
+// succeeds, flags the connection as hijacked so Status and subsequent
+// writes stop being trusted. A failed hijack (connection already taken,
+// writer doesn't support it, ...) leaves the request to be recorded
+// normally, since the handler will fall back to writing a real response
+// through this same writer.
+func (d *responseDelegator) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := d.ResponseWriter.Hijack()
+	if err == nil {
+		d.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Status returns the status code written through this delegator. If the
+// connection was hijacked before any status was observed, it returns 0,
+// since neither we nor gin can know what was sent afterwards. Otherwise,
+// if nothing was ever explicitly written, it forwards to the wrapped
+// writer, which reports gin's implicit 200 rather than our zero value.
+func (d *responseDelegator) Status() int {
+	if !d.wroteHdr {
+		if d.hijacked {
+			return 0
+		}
+		return d.ResponseWriter.Status()
+	}
+	return d.status
+}
+
+// Size returns the number of response bytes written through this
+// delegator, as opposed to gin's own Size() which is -1 until the first
+// write.
+func (d *responseDelegator) Size() int {
+	return d.size
+}
+
+// Hijacked reports whether the underlying connection was hijacked, e.g.
+// for a websocket upgrade.
+func (d *responseDelegator) Hijacked() bool {
+	return d.hijacked
+}
+
+var _ io.ReaderFrom = (*responseDelegator)(nil)
+
+// ReadFrom forwards to the wrapped writer's io.ReaderFrom implementation
+// when it has one, tracking the bytes copied; otherwise it falls back to a
+// plain io.Copy through Write.
+func (d *responseDelegator) ReadFrom(r io.Reader) (int64, error) {
+	if !d.wroteHdr {
+		d.WriteHeader(http.StatusOK)
+	}
+	if rf, ok := d.ResponseWriter.(io.ReaderFrom); ok {
+		n, err := rf.ReadFrom(r)
+		d.size += int(n)
+		return n, err
+	}
+	return io.Copy(struct{ io.Writer }{d}, r)
+}
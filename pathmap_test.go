@@ -0,0 +1,69 @@
+package ginprom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// handlerFor returns the handler name gin.Engine.Routes() recorded for
+// path, so tests can look up PathMap entries without simulating a request.
+func handlerFor(r *gin.Engine, path string) string {
+	for _, ri := range r.Routes() {
+		if ri.Path == path {
+			return ri.Handler
+		}
+	}
+	return ""
+}
+
+func TestUpdatePicksUpNewRoutesAfterThrottleWindow(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	orig := minRouteRefreshInterval
+	minRouteRefreshInterval = 50 * time.Millisecond
+	defer func() { minRouteRefreshInterval = orig }()
+
+	r := gin.New()
+	r.GET("/a", func(c *gin.Context) {})
+	p := New(Registry(prometheus.NewRegistry()), Engine(r))
+
+	p.update()
+	aHandler := handlerFor(r, "/a")
+	if path, ok := p.get(aHandler); !ok || path != "/a" {
+		t.Fatalf("expected /a to be mapped after the first update, got %q, %v", path, ok)
+	}
+
+	r.GET("/b", func(c *gin.Context) {})
+	bHandler := handlerFor(r, "/b")
+
+	// Still inside the throttle window: the walk is skipped, so the route
+	// added after the first update isn't visible yet.
+	p.update()
+	if _, ok := p.get(bHandler); ok {
+		t.Fatal("expected /b not to be mapped before the throttle window elapses")
+	}
+
+	time.Sleep(2 * minRouteRefreshInterval)
+
+	p.update()
+	if path, ok := p.get(bHandler); !ok || path != "/b" {
+		t.Fatalf("expected /b to be mapped once the throttle window elapsed, got %q, %v", path, ok)
+	}
+}
+
+func TestUpdateIgnoresIgnoredPaths(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.GET("/health", func(c *gin.Context) {})
+	p := New(Registry(prometheus.NewRegistry()), Engine(r), Ignore("/health"))
+
+	p.update()
+	handler := handlerFor(r, "/health")
+	if _, ok := p.get(handler); ok {
+		t.Fatal("expected an ignored path to stay out of PathMap")
+	}
+}
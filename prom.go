@@ -4,8 +4,8 @@
 package ginprom
 
 import (
+	"crypto/subtle"
 	"errors"
-	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -20,8 +20,26 @@ import (
 var defaultPath = "/metrics"
 var defaultNs = "gin"
 var defaultSys = "gonic"
+var defaultUnknownPath = "<unknown>"
+
+// minRouteRefreshInterval bounds how often update() re-walks
+// Engine.Routes(), which recursively walks gin's radix trees and resolves
+// each route's handler name via runtime.FuncForPC — not cheap, and not
+// something gin exposes a cheaper "did routes change" signal for.
+// Without this, a steady stream of genuine 404s (which always miss
+// PathMap) would pay that walk on every single request.
+var minRouteRefreshInterval = time.Second
 var errInvalidToken = errors.New("Invalid or missing token")
 
+// defaultHistogramBuckets are the buckets, in milliseconds, used for the
+// request duration histogram when none is supplied via HistogramBuckets.
+var defaultHistogramBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// defaultSizeBuckets are the buckets, in bytes, used for the request and
+// response size histograms when none is supplied via RequestSizeBuckets or
+// ResponseSizeBuckets.
+var defaultSizeBuckets = prometheus.ExponentialBuckets(100, 10, 7)
+
 type pmap struct {
 	sync.RWMutex
 	values map[string]string
@@ -34,8 +52,12 @@ type pmapb struct {
 
 // Prometheus contains the metrics gathered by the instance and its path
 type Prometheus struct {
-	reqCnt               *prometheus.CounterVec
-	reqDur, reqSz, resSz *prometheus.SummaryVec
+	reqCnt      *prometheus.CounterVec
+	reqErr      *prometheus.CounterVec
+	reqInFlight *prometheus.GaugeVec
+
+	reqDurHist, reqSzHist, resSzHist *prometheus.HistogramVec
+	reqDur, reqSz, resSz             *prometheus.SummaryVec
 
 	MetricsPath string
 	Namespace   string
@@ -44,6 +66,51 @@ type Prometheus struct {
 	Ignored     pmapb
 	Engine      *gin.Engine
 	PathMap     pmap
+
+	// UnknownPath is the path label recorded for requests whose handler
+	// isn't in PathMap (most commonly 404s), instead of dropping them from
+	// metrics entirely. Overridden per-request by OnUnknownHandler, if set.
+	UnknownPath string
+
+	// OnUnknownHandler is consulted whenever a request's handler isn't in
+	// PathMap. It returns the path label to record and whether to record
+	// the request at all; returning record=false drops it, matching the
+	// pre-existing behavior.
+	OnUnknownHandler func(c *gin.Context) (path string, record bool)
+
+	// routeCount is the number of routes seen at the last PathMap rebuild,
+	// guarded by PathMap's lock. It lets update() skip re-populating
+	// PathMap when Engine.Routes() comes back unchanged.
+	routeCount int
+
+	// lastUpdate is when update() last actually walked Engine.Routes(),
+	// guarded by PathMap's lock. It throttles how often that walk happens.
+	lastUpdate time.Time
+
+	useSummaries        bool
+	histogramBuckets    []float64
+	requestSizeBuckets  []float64
+	responseSizeBuckets []float64
+
+	// HandlerNameFunc overrides how the "handler" label is derived when
+	// WithHandlerLabel is set. Defaults to c.HandlerName().
+	HandlerNameFunc func(*gin.Context) string
+
+	// LabelExtractor computes extra low-cardinality label values (tenant,
+	// api_version, route group, ...) attached to every metric. Set via the
+	// LabelExtractor option, which also declares the label names.
+	LabelExtractor func(*gin.Context) prometheus.Labels
+
+	withHandlerLabel bool
+	extraLabelNames  []string
+
+	registry prometheus.Registerer
+	gatherer prometheus.Gatherer
+
+	trackHijacked bool
+
+	tokens   []string
+	authFunc func(*gin.Context) bool
 }
 
 // Path is an option allowing to set the metrics path when intializing with New
@@ -89,6 +156,24 @@ func Token(token string) func(*Prometheus) {
 	}
 }
 
+// Tokens is an option allowing to set multiple valid bearer tokens, so a
+// token can be rotated by accepting both the old and new value for a
+// transition period. All tokens are compared in constant time.
+func Tokens(tokens ...string) func(*Prometheus) {
+	return func(p *Prometheus) {
+		p.tokens = append(p.tokens, tokens...)
+	}
+}
+
+// Auth replaces bearer token authentication on MetricsPath with a custom
+// check, e.g. an mTLS client-cert CN check, an IP allowlist, or a
+// Vault-style ACL policy lookup. When set, Token and Tokens are ignored.
+func Auth(fn func(*gin.Context) bool) func(*Prometheus) {
+	return func(p *Prometheus) {
+		p.authFunc = fn
+	}
+}
+
 // Engine is an option allowing to set the gin engine when intializing with New.
 // Example :
 // r := gin.Default()
@@ -99,46 +184,197 @@ func Engine(e *gin.Engine) func(*Prometheus) {
 	}
 }
 
+// UseSummaries switches the request duration, request size and response
+// size metrics back to SummaryVec instead of the default HistogramVec.
+// Summaries can't be aggregated across instances and don't support
+// PromQL quantile queries, so this only exists for backward compatibility
+// with dashboards built against older versions of ginprom.
+func UseSummaries() func(*Prometheus) {
+	return func(p *Prometheus) {
+		p.useSummaries = true
+	}
+}
+
+// HistogramBuckets overrides the default buckets, in milliseconds, used for
+// the request duration histogram.
+func HistogramBuckets(buckets []float64) func(*Prometheus) {
+	return func(p *Prometheus) {
+		p.histogramBuckets = buckets
+	}
+}
+
+// RequestSizeBuckets overrides the default buckets, in bytes, used for the
+// request size histogram.
+func RequestSizeBuckets(buckets []float64) func(*Prometheus) {
+	return func(p *Prometheus) {
+		p.requestSizeBuckets = buckets
+	}
+}
+
+// ResponseSizeBuckets overrides the default buckets, in bytes, used for the
+// response size histogram.
+func ResponseSizeBuckets(buckets []float64) func(*Prometheus) {
+	return func(p *Prometheus) {
+		p.responseSizeBuckets = buckets
+	}
+}
+
+// WithHandlerLabel re-enables the "handler" label on every metric, set to
+// the gin handler name for the matched route (or the value returned by
+// HandlerNameFunc, if one is supplied). This label is opt-in because a
+// misconfigured router can make it high-cardinality.
+func WithHandlerLabel() func(*Prometheus) {
+	return func(p *Prometheus) {
+		p.withHandlerLabel = true
+	}
+}
+
+// HandlerNameFunc overrides how the "handler" label is derived when
+// WithHandlerLabel is set.
+func HandlerNameFunc(fn func(*gin.Context) string) func(*Prometheus) {
+	return func(p *Prometheus) {
+		p.HandlerNameFunc = fn
+	}
+}
+
+// LabelExtractor registers a set of additional low-cardinality labels,
+// attached to every metric, computed from the request context by fn. names
+// must match the keys fn returns; a missing key is recorded as an empty
+// string.
+// Example : ginprom.New(ginprom.LabelExtractor([]string{"tenant"}, func(c *gin.Context) prometheus.Labels {
+//     return prometheus.Labels{"tenant": c.GetString("tenant")}
+// }))
+func LabelExtractor(names []string, fn func(*gin.Context) prometheus.Labels) func(*Prometheus) {
+	return func(p *Prometheus) {
+		p.extraLabelNames = names
+		p.LabelExtractor = fn
+	}
+}
+
+// Registry sets the prometheus.Registerer metrics are registered against,
+// instead of the global default registry. This is a prerequisite for
+// running more than one Prometheus instance in a single process (tests,
+// multi-tenant embedding) without colliding on re-registration.
+func Registry(r prometheus.Registerer) func(*Prometheus) {
+	return func(p *Prometheus) {
+		p.registry = r
+	}
+}
+
+// Gatherer sets the prometheus.Gatherer used to serve MetricsPath, instead
+// of the global default registry. Pair with Registry when using a custom
+// registry.
+func Gatherer(g prometheus.Gatherer) func(*Prometheus) {
+	return func(p *Prometheus) {
+		p.gatherer = g
+	}
+}
+
+// UnknownPath overrides the path label recorded for requests whose handler
+// isn't in PathMap (most commonly 404s). Defaults to "<unknown>".
+func UnknownPath(path string) func(*Prometheus) {
+	return func(p *Prometheus) {
+		p.UnknownPath = path
+	}
+}
+
+// OnUnknownHandler installs a hook consulted whenever a request's handler
+// isn't in PathMap, in place of the default UnknownPath bucketing. Return
+// record=false to drop the request from metrics entirely, matching the
+// pre-existing behavior.
+func OnUnknownHandler(fn func(c *gin.Context) (path string, record bool)) func(*Prometheus) {
+	return func(p *Prometheus) {
+		p.OnUnknownHandler = fn
+	}
+}
+
+// TrackHijacked controls whether requests whose connection is hijacked
+// (e.g. a websocket upgrade) are still recorded. When track is false
+// (the default), a hijacked request is left out of every metric, since its
+// real status and size are no longer observable. When true, it is recorded
+// under a synthetic "101" status instead.
+func TrackHijacked(track bool) func(*Prometheus) {
+	return func(p *Prometheus) {
+		p.trackHijacked = track
+	}
+}
+
 // New will initialize a new Prometheus instance with the given options.
 // If no options are passed, sane defaults are used.
 // If a router is passed using the Engine() option, this instance will
 // automatically bind to it.
 func New(options ...func(*Prometheus)) *Prometheus {
 	p := &Prometheus{
-		MetricsPath: defaultPath,
-		Namespace:   defaultNs,
-		Subsystem:   defaultSys,
+		MetricsPath:         defaultPath,
+		Namespace:           defaultNs,
+		Subsystem:           defaultSys,
+		UnknownPath:         defaultUnknownPath,
+		histogramBuckets:    defaultHistogramBuckets,
+		requestSizeBuckets:  defaultSizeBuckets,
+		responseSizeBuckets: defaultSizeBuckets,
 	}
 	p.Ignored.values = make(map[string]bool)
 	for _, option := range options {
 		option(p)
 	}
+	if p.registry == nil {
+		p.registry = prometheus.DefaultRegisterer
+	}
+	if p.gatherer == nil {
+		// A custom Registry is almost always also its own Gatherer (true
+		// for the common *prometheus.Registry case); prefer that over the
+		// global default so /metrics actually serves what was registered.
+		if g, ok := p.registry.(prometheus.Gatherer); ok {
+			p.gatherer = g
+		} else {
+			p.gatherer = prometheus.DefaultGatherer
+		}
+	}
 	p.register()
 	if p.Engine != nil {
-		p.Engine.GET(p.MetricsPath, prometheusHandler(p.Token))
+		p.Engine.GET(p.MetricsPath, p.metricsHandler())
 	}
 
 	return p
 }
 
+// update rebuilds PathMap from the engine's currently registered routes.
+// It's called whenever a handler lookup misses, so routes added after the
+// first request are picked up incrementally. The actual Engine.Routes()
+// walk is throttled to once per minRouteRefreshInterval, since that's the
+// expensive part; within that window a miss just reuses what's already in
+// PathMap. Once the walk does run, it skips re-populating PathMap if the
+// route count hasn't changed since the last rebuild.
 func (p *Prometheus) update() {
+	if p.Engine == nil {
+		return
+	}
+
 	p.PathMap.Lock()
-	p.Ignored.RLock()
+	defer p.PathMap.Unlock()
 	if p.PathMap.values == nil {
 		p.PathMap.values = make(map[string]string)
 	}
-	defer func() {
-		p.PathMap.Unlock()
-		p.Ignored.RUnlock()
-	}()
-	if p.Engine != nil {
-		for _, ri := range p.Engine.Routes() {
-			if _, ok := p.Ignored.values[ri.Path]; ok {
-				continue
-			}
-			p.PathMap.values[ri.Handler] = ri.Path
+	if now := time.Now(); now.Sub(p.lastUpdate) < minRouteRefreshInterval {
+		return
+	} else {
+		p.lastUpdate = now
+	}
+
+	routes := p.Engine.Routes()
+	if len(routes) == p.routeCount {
+		return
+	}
+
+	p.Ignored.RLock()
+	defer p.Ignored.RUnlock()
+	for _, ri := range routes {
+		if _, ok := p.Ignored.values[ri.Path]; ok {
+			continue
 		}
+		p.PathMap.values[ri.Handler] = ri.Path
 	}
+	p.routeCount = len(routes)
 }
 
 func (p *Prometheus) get(handler string) (string, bool) {
@@ -148,8 +384,41 @@ func (p *Prometheus) get(handler string) (string, bool) {
 	return in, ok
 }
 
+// baseLabelNames returns the label names shared by every metric. Every
+// metric except the in-flight gauge also carries "code" ahead of these.
+// Order here must match the order dynamicLabelValues appends in.
+func (p *Prometheus) baseLabelNames() []string {
+	names := []string{"method", "host", "path"}
+	if p.withHandlerLabel {
+		names = append(names, "handler")
+	}
+	return append(names, p.extraLabelNames...)
+}
+
+// dynamicLabelValues computes the values for the "handler" label (if
+// enabled) and any LabelExtractor labels, in the same order baseLabelNames
+// appends them in. It is called once per request and the result reused
+// across all metrics so a LabelExtractor only runs once.
+func (p *Prometheus) dynamicLabelValues(c *gin.Context) []string {
+	var values []string
+	if p.withHandlerLabel {
+		name := c.HandlerName()
+		if p.HandlerNameFunc != nil {
+			name = p.HandlerNameFunc(c)
+		}
+		values = append(values, name)
+	}
+	if p.LabelExtractor != nil {
+		extra := p.LabelExtractor(c)
+		for _, n := range p.extraLabelNames {
+			values = append(values, extra[n])
+		}
+	}
+	return values
+}
+
 func (p *Prometheus) register() {
-	labels := []string{"code", "method" /*"handler",*/, "host", "path"}
+	labels := append([]string{"code"}, p.baseLabelNames()...)
 	p.reqCnt = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: p.Namespace,
@@ -159,107 +428,222 @@ func (p *Prometheus) register() {
 		},
 		labels,
 	)
-	prometheus.MustRegister(p.reqCnt)
+	p.registry.MustRegister(p.reqCnt)
+
+	p.reqErr = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: p.Namespace,
+			Subsystem: p.Subsystem,
+			Name:      "request_errors_total",
+			Help:      "How many HTTP requests resulted in an error (gin context errors or a 5xx status), partitioned by status code and HTTP method.",
+		},
+		labels,
+	)
+	p.registry.MustRegister(p.reqErr)
 
-	p.reqDur = prometheus.NewSummaryVec(
-		prometheus.SummaryOpts{
+	p.reqInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: p.Namespace,
+			Subsystem: p.Subsystem,
+			Name:      "requests_in_flight",
+			Help:      "The number of HTTP requests currently being served.",
+		},
+		p.baseLabelNames(),
+	)
+	p.registry.MustRegister(p.reqInFlight)
+
+	if p.useSummaries {
+		p.reqDur = prometheus.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Namespace: p.Namespace,
+				Subsystem: p.Subsystem,
+				Name:      "request_duration_milliseconds",
+				Help:      "The HTTP request latencies in milliseconds.",
+			},
+			labels,
+		)
+		p.registry.MustRegister(p.reqDur)
+
+		p.reqSz = prometheus.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Namespace: p.Namespace,
+				Subsystem: p.Subsystem,
+				Name:      "request_size_bytes",
+				Help:      "The HTTP request sizes in bytes.",
+			},
+			labels,
+		)
+		p.registry.MustRegister(p.reqSz)
+
+		p.resSz = prometheus.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Namespace: p.Namespace,
+				Subsystem: p.Subsystem,
+				Name:      "response_size_bytes",
+				Help:      "The HTTP response sizes in bytes.",
+			},
+			labels,
+		)
+		p.registry.MustRegister(p.resSz)
+		return
+	}
+
+	p.reqDurHist = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
 			Namespace: p.Namespace,
 			Subsystem: p.Subsystem,
 			Name:      "request_duration_milliseconds",
 			Help:      "The HTTP request latencies in milliseconds.",
+			Buckets:   p.histogramBuckets,
 		},
 		labels,
 	)
-	prometheus.MustRegister(p.reqDur)
+	p.registry.MustRegister(p.reqDurHist)
 
-	p.reqSz = prometheus.NewSummaryVec(
-		prometheus.SummaryOpts{
+	p.reqSzHist = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
 			Namespace: p.Namespace,
 			Subsystem: p.Subsystem,
 			Name:      "request_size_bytes",
 			Help:      "The HTTP request sizes in bytes.",
+			Buckets:   p.requestSizeBuckets,
 		},
 		labels,
 	)
-	prometheus.MustRegister(p.reqSz)
+	p.registry.MustRegister(p.reqSzHist)
 
-	p.resSz = prometheus.NewSummaryVec(
-		prometheus.SummaryOpts{
+	p.resSzHist = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
 			Namespace: p.Namespace,
 			Subsystem: p.Subsystem,
 			Name:      "response_size_bytes",
 			Help:      "The HTTP response sizes in bytes.",
+			Buckets:   p.responseSizeBuckets,
 		},
 		labels,
 	)
-	prometheus.MustRegister(p.resSz)
+	p.registry.MustRegister(p.resSzHist)
 }
 
 // Instrument is a gin middleware that can be used to generate metrics for a
 // single handler
 func (p *Prometheus) Instrument() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		p.PathMap.RLock()
-		if p.PathMap.values == nil {
-			p.PathMap.RUnlock()
+		path, found := p.get(c.HandlerName())
+		if !found {
 			p.update()
-		} else {
-			p.PathMap.RUnlock()
+			path, found = p.get(c.HandlerName())
 		}
-		var path string
-		var found bool
+		if !found {
+			record := true
+			if p.OnUnknownHandler != nil {
+				path, record = p.OnUnknownHandler(c)
+			} else {
+				path = p.UnknownPath
+			}
+			if !record {
+				c.Next()
+				return
+			}
+		}
+
+		method := c.Request.Method
+		host := strings.ToLower(c.Request.Host)
+		reqSz := computeApproximateRequestSize(c.Request)
+
+		base := []string{method, host, path}
+		dynamic := p.dynamicLabelValues(c)
+		baseValues := append(append([]string{}, base...), dynamic...)
+
+		inFlight := p.reqInFlight.WithLabelValues(baseValues...)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		rw := newResponseDelegator(c.Writer)
+		c.Writer = rw
 
 		start := time.Now()
+		c.Next()
+		elapsed := float64(time.Since(start)) / float64(time.Millisecond)
 
-		if path, found = p.get(c.HandlerName()); !found {
-			c.Next()
+		if rw.Hijacked() && !p.trackHijacked {
 			return
 		}
-		reqSz := computeApproximateRequestSize(c.Request)
 
-		c.Next()
+		status := strconv.Itoa(rw.Status())
+		if rw.Hijacked() {
+			status = "101"
+		}
+		resSz := float64(rw.Size())
 
-		status := strconv.Itoa(c.Writer.Status())
-		elapsed := float64(time.Since(start)) / float64(time.Millisecond)
-		resSz := float64(c.Writer.Size())
+		values := append([]string{status}, baseValues...)
 
-		host := strings.ToLower(c.Request.Host)
-		p.reqDur.WithLabelValues(status, c.Request.Method /*c.HandlerName(),*/, host, path).Observe(elapsed)
-		p.reqCnt.WithLabelValues(status, c.Request.Method /*c.HandlerName(),*/, host, path).Inc()
-		p.reqSz.WithLabelValues(status, c.Request.Method /*c.HandlerName(),*/, host, path).Observe(float64(reqSz))
-		p.resSz.WithLabelValues(status, c.Request.Method /*c.HandlerName(),*/, host, path).Observe(resSz)
+		p.reqCnt.WithLabelValues(values...).Inc()
+		if len(c.Errors) > 0 || c.Writer.Status() >= http.StatusInternalServerError {
+			p.reqErr.WithLabelValues(values...).Inc()
+		}
+
+		if p.useSummaries {
+			p.reqDur.WithLabelValues(values...).Observe(elapsed)
+			p.reqSz.WithLabelValues(values...).Observe(float64(reqSz))
+			p.resSz.WithLabelValues(values...).Observe(resSz)
+			return
+		}
+		p.reqDurHist.WithLabelValues(values...).Observe(elapsed)
+		p.reqSzHist.WithLabelValues(values...).Observe(float64(reqSz))
+		p.resSzHist.WithLabelValues(values...).Observe(resSz)
 	}
 }
 
 // Use is a method that should be used if the engine is set after middleware
 // initialization
 func (p *Prometheus) Use(e *gin.Engine) {
-	e.GET(p.MetricsPath, prometheusHandler(p.Token))
+	e.GET(p.MetricsPath, p.metricsHandler())
 	p.Engine = e
 }
 
-func prometheusHandler(token string) gin.HandlerFunc {
-	h := promhttp.Handler()
+// metricsHandler builds the single middleware chain serving MetricsPath, so
+// New() and Use() authenticate and gather identically regardless of when
+// the engine is bound.
+func (p *Prometheus) metricsHandler() gin.HandlerFunc {
+	h := promhttp.HandlerFor(p.gatherer, promhttp.HandlerOpts{})
 	return func(c *gin.Context) {
-		if token == "" {
-			h.ServeHTTP(c.Writer, c.Request)
-			return
-		}
-
-		header := c.Request.Header.Get("Authorization")
-
-		if header == "" {
+		if !p.authorized(c) {
 			c.String(http.StatusUnauthorized, errInvalidToken.Error())
 			return
 		}
+		h.ServeHTTP(c.Writer, c.Request)
+	}
+}
 
-		bearer := fmt.Sprintf("Bearer %s", token)
+// authorized reports whether the request may reach MetricsPath. With Auth
+// set, it alone decides. Otherwise, with neither Token nor Tokens
+// configured the route is open (the pre-existing default); with either
+// set, the bearer token must match Token or one of Tokens, compared in
+// constant time to avoid timing side-channels. Token is checked directly
+// (not just what Token() captured at option time) so the pre-existing
+// p.Token = "..." field-assignment idiom keeps gating the endpoint.
+func (p *Prometheus) authorized(c *gin.Context) bool {
+	if p.authFunc != nil {
+		return p.authFunc(c)
+	}
+	if p.Token == "" && len(p.tokens) == 0 {
+		return true
+	}
 
-		if header != bearer {
-			c.String(http.StatusUnauthorized, errInvalidToken.Error())
-			return
+	const prefix = "Bearer "
+	header := c.Request.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	supplied := []byte(strings.TrimPrefix(header, prefix))
+	if p.Token != "" && subtle.ConstantTimeCompare(supplied, []byte(p.Token)) == 1 {
+		return true
+	}
+	for _, token := range p.tokens {
+		if subtle.ConstantTimeCompare(supplied, []byte(token)) == 1 {
+			return true
 		}
-
-		h.ServeHTTP(c.Writer, c.Request)
 	}
+	return false
 }